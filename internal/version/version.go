@@ -8,6 +8,7 @@ package version
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"errors"
@@ -112,10 +113,18 @@ func install(targetDir, version string) error {
 		return err
 	}
 	if err := verifySHA256(archiveFile, strings.TrimSpace(wantSHA)); err != nil {
+		// Otherwise the bad archive, which has the expected size,
+		// would be reused by every later download.
+		os.Remove(archiveFile)
 		return fmt.Errorf("error verifying SHA256 of %v: %v", archiveFile, err)
 	}
 	log.Printf("Unpacking %v ...", archiveFile)
 	if err := unpackArchive(targetDir, archiveFile); err != nil {
+		if _, ok := err.(*unsafePathError); ok {
+			// Don't leave a partially unpacked tree from a
+			// malicious archive lying around.
+			os.RemoveAll(targetDir)
+		}
 		return fmt.Errorf("extracting archive %v: %v", archiveFile, err)
 	}
 	if err := ioutil.WriteFile(filepath.Join(targetDir, unpackedOkay), nil, 0644); err != nil {
@@ -128,14 +137,47 @@ func install(targetDir, version string) error {
 // unpackArchive unpacks the provided archive zip or tar.gz file to targetDir,
 // removing the "go/" prefix from file entries.
 func unpackArchive(targetDir, archiveFile string) error {
-	switch {
-	case strings.HasSuffix(archiveFile, ".zip"):
+	format, err := archiveFormat(archiveFile)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case ".zip":
 		return unpackZip(targetDir, archiveFile)
-	case strings.HasSuffix(archiveFile, ".tar.gz"):
+	case ".tar.gz":
 		return unpackTarGz(targetDir, archiveFile)
 	default:
-		return errors.New("unsupported archive file")
+		return fmt.Errorf("unsupported archive file %s: not a zip or tar.gz file", archiveFile)
+	}
+}
+
+// archiveFormat returns the format of archiveFile, either ".zip" or
+// ".tar.gz", sniffed from the file's leading bytes so that a mislabeled
+// archive still unpacks. A file named ".zip" without the zip signature is
+// also treated as a zip, since a zip with leading data still has a readable
+// central directory. It returns "" if the format is not recognized.
+func archiveFormat(archiveFile string) (string, error) {
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
 	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		return ".tar.gz", nil
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return ".zip", nil
+	}
+	if strings.HasSuffix(archiveFile, ".zip") {
+		return ".zip", nil
+	}
+	return "", nil
 }
 
 // unpackTarGz is the tar.gz implementation of unpackArchive.
@@ -159,11 +201,10 @@ func unpackTarGz(targetDir, archiveFile string) error {
 		if err != nil {
 			return err
 		}
-		if !validRelPath(f.Name) {
-			return fmt.Errorf("tar file contained invalid name %q", f.Name)
+		abs, err := archiveEntryPath(targetDir, f.Name)
+		if err != nil {
+			return err
 		}
-		rel := filepath.FromSlash(strings.TrimPrefix(f.Name, "go/"))
-		abs := filepath.Join(targetDir, rel)
 
 		fi := f.FileInfo()
 		mode := fi.Mode()
@@ -225,9 +266,10 @@ func unpackZip(targetDir, archiveFile string) error {
 	defer zr.Close()
 
 	for _, f := range zr.File {
-		name := strings.TrimPrefix(f.Name, "go/")
-
-		outpath := filepath.Join(targetDir, name)
+		outpath, err := archiveEntryPath(targetDir, f.Name)
+		if err != nil {
+			return err
+		}
 		if f.FileInfo().IsDir() {
 			if err := os.MkdirAll(outpath, 0755); err != nil {
 				return err
@@ -296,18 +338,34 @@ func slurpURLToString(url_ string) (string, error) {
 	return string(slurp), nil
 }
 
+// downloadAttempts is the number of times copyFromURL tries to fetch an
+// archive before giving up.
+const downloadAttempts = 3
+
+// retryDelay is how long copyFromURL waits before its first retry. The
+// wait grows with each further attempt.
+var retryDelay = 2 * time.Second
+
+// retryableError marks a resumeFromURL failure that may succeed if tried
+// again, such as a dropped connection or a 503 from the server. Other
+// errors, like a 404, are returned to the caller right away.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
 // copyFromURL downloads srcURL to dstFile.
-func copyFromURL(dstFile, srcURL string) (err error) {
-	f, err := os.Create(dstFile)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			f.Close()
-			os.Remove(dstFile)
-		}
-	}()
+//
+// The data is first written to dstFile+".part". If the transfer is
+// interrupted, it is retried, resuming from the bytes already on disk with a
+// Range request. The request carries an If-Range validator recorded from the
+// response that started the partial file, so if the object has changed, or
+// the server doesn't support ranges, it replies with the full body and the
+// download restarts from scratch. The partial file and its validator are kept
+// on failure so that a later download can pick up where this one left off.
+func copyFromURL(dstFile, srcURL string) error {
+	partFile := dstFile + ".part"
 	c := &http.Client{
 		Transport: &userAgentTransport{&http.Transport{
 			// It's already compressed. Prefer accurate ContentLength.
@@ -317,24 +375,155 @@ func copyFromURL(dstFile, srcURL string) (err error) {
 			Proxy:              http.ProxyFromEnvironment,
 		}},
 	}
-	res, err := c.Get(srcURL)
+	for attempt := 1; ; attempt++ {
+		err := resumeFromURL(c, partFile, srcURL)
+		if err == nil {
+			break
+		}
+		re, ok := err.(*retryableError)
+		if !ok {
+			return err
+		}
+		if attempt == downloadAttempts {
+			return re.err
+		}
+		delay := time.Duration(attempt) * retryDelay
+		log.Printf("Download interrupted: %v; retrying in %v ...", re.err, delay)
+		time.Sleep(delay)
+	}
+	os.Remove(validatorFile(partFile))
+	return os.Rename(partFile, dstFile)
+}
+
+// validatorFile returns the name of the file recording the If-Range
+// validator for partFile.
+func validatorFile(partFile string) string {
+	return partFile + ".validator"
+}
+
+// discardPart empties the partial download f, named partFile, and removes
+// its validator so that the next request fetches the whole archive.
+func discardPart(f *os.File, partFile string) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if err := os.Remove(validatorFile(partFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// responseValidator returns the value to send as If-Range to resume the
+// download started by res: its strong ETag, or else its Last-Modified time.
+// It returns "" if the response has neither.
+func responseValidator(res *http.Response) string {
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return res.Header.Get("Last-Modified")
+}
+
+// resumeFromURL downloads srcURL to partFile, continuing from the end of
+// partFile if it already has contents, a validator for them was recorded,
+// and the server honors the request.
+func resumeFromURL(c *http.Client, partFile, srcURL string) (err error) {
+	f, err := os.OpenFile(partFile, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+	validator, err := ioutil.ReadFile(validatorFile(partFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", srcURL, nil)
+	if err != nil {
+		return err
+	}
+	// Without a validator there's no telling whether the partial file
+	// belongs to the object the server has now, so fetch it all again.
+	if offset > 0 && len(validator) > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(validator))
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return &retryableError{err}
+	}
 	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
+	total := res.ContentLength
+	switch res.StatusCode {
+	case http.StatusOK:
+		// Either nothing was downloaded yet, the object changed since
+		// the partial file was started, or the server ignored the
+		// Range header. Start over.
+		offset = 0
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if v := responseValidator(res); v != "" {
+			if err := ioutil.WriteFile(validatorFile(partFile), []byte(v), 0644); err != nil {
+				return err
+			}
+		} else if err := os.Remove(validatorFile(partFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			// Resuming this partial file will keep failing the same
+			// way. Discard it so that the next attempt starts over.
+			if err := discardPart(f, partFile); err != nil {
+				return err
+			}
+			return &retryableError{fmt.Errorf("server returned unexpected Content-Range %q for offset %d", res.Header.Get("Content-Range"), offset)}
+		}
+		if total != -1 {
+			total += offset
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is no good (e.g. larger than the archive).
+		// Discard it so that the next attempt starts from scratch.
+		if err := discardPart(f, partFile); err != nil {
+			return err
+		}
+		return &retryableError{errors.New(res.Status)}
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return &retryableError{errors.New(res.Status)}
+	default:
+		if res.StatusCode >= 500 {
+			// Likely a transient failure of the server or a proxy.
+			return &retryableError{errors.New(res.Status)}
+		}
 		return errors.New(res.Status)
 	}
-	pw := &progressWriter{w: f, total: res.ContentLength}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	pw := &progressWriter{w: f, n: offset, total: total}
 	n, err := io.Copy(pw, res.Body)
 	if err != nil {
-		return err
+		if _, ok := err.(*os.PathError); ok {
+			// Failed writing to partFile, not reading the body.
+			return err
+		}
+		return &retryableError{err}
 	}
-	if res.ContentLength != -1 && res.ContentLength != n {
-		return fmt.Errorf("copied %v bytes; expected %v", n, res.ContentLength)
+	if total != -1 && offset+n != total {
+		return &retryableError{fmt.Errorf("copied %v bytes; expected %v", offset+n, total)}
 	}
 	pw.update() // 100%
-	return f.Close()
+	return nil
 }
 
 type progressWriter struct {
@@ -378,6 +567,10 @@ func getOS() string {
 	return runtime.GOOS
 }
 
+// archiveBaseURL is the location that Go release archives are downloaded
+// from. It is a variable for testing.
+var archiveBaseURL = "https://storage.googleapis.com/golang/"
+
 // versionArchiveURL returns the zip or tar.gz URL of the given Go version.
 func versionArchiveURL(version string) string {
 	goos := getOS()
@@ -394,7 +587,7 @@ func versionArchiveURL(version string) string {
 	if goos == "linux" && runtime.GOARCH == "arm" {
 		arch = "armv6l"
 	}
-	return "https://storage.googleapis.com/golang/" + version + "." + goos + "-" + arch + ext
+	return archiveBaseURL + version + "." + goos + "-" + arch + ext
 }
 
 const caseInsensitiveEnv = runtime.GOOS == "windows"
@@ -438,6 +631,36 @@ func homedir() (string, error) {
 	}
 }
 
+// unsafePathError is returned by unpackArchive for an archive entry that
+// would be written outside of the target directory.
+type unsafePathError struct {
+	name string
+}
+
+func (e *unsafePathError) Error() string {
+	return fmt.Sprintf("archive contained unsafe entry name %q", e.name)
+}
+
+// archiveEntryPath returns the path that the archive entry name should be
+// unpacked to, removing its "go/" prefix. It returns an *unsafePathError if
+// the entry would resolve to a location outside of targetDir.
+func archiveEntryPath(targetDir, name string) (string, error) {
+	if !validRelPath(name) {
+		return "", &unsafePathError{name}
+	}
+	rel := filepath.FromSlash(strings.TrimPrefix(name, "go/"))
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		// Such as "C:/evil" on Windows, which validRelPath accepts.
+		return "", &unsafePathError{name}
+	}
+	targetDir = filepath.Clean(targetDir)
+	abs := filepath.Join(targetDir, rel)
+	if abs != targetDir && !strings.HasPrefix(abs, targetDir+string(filepath.Separator)) {
+		return "", &unsafePathError{name}
+	}
+	return abs, nil
+}
+
 func validRelPath(p string) bool {
 	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
 		return false
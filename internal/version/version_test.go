@@ -5,8 +5,24 @@
 package version
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDedupEnv(t *testing.T) {
@@ -33,3 +49,545 @@ func TestDedupEnv(t *testing.T) {
 		}
 	}
 }
+
+// requestLog records the Range and If-Range headers of the requests that a
+// test server receives. It is safe for concurrent use.
+type requestLog struct {
+	mu      sync.Mutex
+	ranges  []string
+	ifRange []string
+}
+
+// add records r and returns the number of requests seen so far.
+func (l *requestLog) add(r *http.Request) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ranges = append(l.ranges, r.Header.Get("Range"))
+	l.ifRange = append(l.ifRange, r.Header.Get("If-Range"))
+	return len(l.ranges)
+}
+
+// get returns the Range and If-Range headers of the requests seen so far.
+func (l *requestLog) get() (ranges, ifRange []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.ranges...), append([]string(nil), l.ifRange...)
+}
+
+// flakyServer serves content with the ETag etag, dropping the connection
+// halfway through the first request. Later requests are served by
+// http.ServeContent, which honors Range and If-Range headers unless noRange
+// is set. If newContent is set, later requests serve it instead, with a
+// different ETag, as if the object changed between requests.
+type flakyServer struct {
+	content    []byte
+	etag       string
+	newContent []byte
+	noRange    bool
+
+	reqs requestLog
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	first := s.reqs.add(r) == 1
+
+	if first {
+		w.Header().Set("ETag", s.etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.content[:len(s.content)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		conn.Close()
+		return
+	}
+	content, etag := s.content, s.etag
+	if s.newContent != nil {
+		content, etag = s.newContent, s.etag+"-new"
+	}
+	if s.noRange {
+		r.Header.Del("Range")
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "archive.tar.gz", time.Time{}, bytes.NewReader(content))
+}
+
+func TestCopyFromURLResume(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	changed := bytes.Repeat([]byte("9876543210"), 10000)
+	tests := []struct {
+		name       string
+		noRange    bool
+		newContent []byte
+		want       []byte
+	}{
+		{name: "resume", want: content},
+		{name: "noRange", noRange: true, want: content},
+		{name: "changed", newContent: changed, want: changed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &flakyServer{
+				content:    content,
+				etag:       `"v1"`,
+				newContent: tt.newContent,
+				noRange:    tt.noRange,
+			}
+			ts := httptest.NewServer(fs)
+			defer ts.Close()
+
+			dir, err := ioutil.TempDir("", "copyfromurl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			dst := filepath.Join(dir, "archive.tar.gz")
+			if err := copyFromURL(dst, ts.URL); err != nil {
+				t.Fatalf("copyFromURL: %v", err)
+			}
+			got, err := ioutil.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("downloaded %d bytes not matching the served %d bytes", len(got), len(tt.want))
+			}
+			if err := verifySHA256(dst, fmt.Sprintf("%x", sha256.Sum256(tt.want))); err != nil {
+				t.Error(err)
+			}
+			if _, err := os.Stat(validatorFile(dst + ".part")); !os.IsNotExist(err) {
+				t.Errorf("validator file left behind after a successful download: %v", err)
+			}
+
+			ranges, ifRange := fs.reqs.get()
+			if len(ranges) != 2 {
+				t.Fatalf("server saw %d requests; want 2", len(ranges))
+			}
+			if want := fmt.Sprintf("bytes=%d-", len(content)/2); ranges[1] != want {
+				t.Errorf("retry sent Range %q; want %q", ranges[1], want)
+			}
+			if ifRange[1] != fs.etag {
+				t.Errorf("retry sent If-Range %q; want %q", ifRange[1], fs.etag)
+			}
+		})
+	}
+}
+
+func TestCopyFromURLNoRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	var reqs requestLog
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs.add(r)
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "copyfromurl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = copyFromURL(filepath.Join(dir, "archive.tar.gz"), ts.URL)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("copyFromURL = %v; want a 404 error", err)
+	}
+	if ranges, _ := reqs.get(); len(ranges) != 1 {
+		t.Errorf("server saw %d requests; want 1", len(ranges))
+	}
+}
+
+func TestCopyFromURLRetryStatus(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var reqs requestLog
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reqs.add(r) == 1 {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "copyfromurl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "archive.tar.gz")
+	if err := copyFromURL(dst, ts.URL); err != nil {
+		t.Fatalf("copyFromURL: %v", err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes not matching the served %d bytes", len(got), len(content))
+	}
+	if ranges, _ := reqs.get(); len(ranges) != 2 {
+		t.Errorf("server saw %d requests; want 2", len(ranges))
+	}
+}
+
+func TestCopyFromURLBadContentRange(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var reqs requestLog
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs.add(r)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("Range") != "" {
+			// Claim to resume from the wrong offset.
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content)
+			return
+		}
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "copyfromurl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A partial file left by an earlier run, with its validator.
+	dst := filepath.Join(dir, "archive.tar.gz")
+	if err := ioutil.WriteFile(dst+".part", content[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(validatorFile(dst+".part"), []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFromURL(dst, ts.URL); err != nil {
+		t.Fatalf("copyFromURL: %v", err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes not matching the served %d bytes", len(got), len(content))
+	}
+	ranges, _ := reqs.get()
+	if want := []string{"bytes=100-", ""}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("server saw Range headers %q; want %q", ranges, want)
+	}
+}
+
+func TestCopyFromURLNoValidator(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var reqs requestLog
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs.add(r)
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "copyfromurl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A partial file from an earlier run, with no recorded validator,
+	// must not be resumed.
+	dst := filepath.Join(dir, "archive.tar.gz")
+	if err := ioutil.WriteFile(dst+".part", []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFromURL(dst, ts.URL); err != nil {
+		t.Fatalf("copyFromURL: %v", err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, starting %q; want the served %d bytes", len(got), got[:5], len(content))
+	}
+	if ranges, _ := reqs.get(); len(ranges) != 1 || ranges[0] != "" {
+		t.Errorf("server saw Range headers %q; want a single request without Range", ranges)
+	}
+}
+
+// archiveEntry is a regular file to be written to a test archive.
+type archiveEntry struct {
+	name, body string
+}
+
+// writeTarGz writes a tar.gz archive holding entries to file.
+func writeTarGz(t *testing.T, file string, entries []archiveEntry) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeZip writes a zip archive holding entries to file.
+func writeZip(t *testing.T, file string, entries []archiveEntry) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var archiveWriters = []struct {
+	ext   string
+	write func(*testing.T, string, []archiveEntry)
+}{
+	{".tar.gz", writeTarGz},
+	{".zip", writeZip},
+}
+
+func TestUnpackArchive(t *testing.T) {
+	for _, aw := range archiveWriters {
+		t.Run(aw.ext, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "unpack")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			archive := filepath.Join(dir, "go1.99.linux-amd64"+aw.ext)
+			aw.write(t, archive, []archiveEntry{
+				{"go/VERSION", "go1.99"},
+				{"go/bin/go", "binary"},
+			})
+			target := filepath.Join(dir, "go1.99")
+			if err := unpackArchive(target, archive); err != nil {
+				t.Fatalf("unpackArchive: %v", err)
+			}
+			for name, want := range map[string]string{"VERSION": "go1.99", "bin/go": "binary"} {
+				got, err := ioutil.ReadFile(filepath.Join(target, filepath.FromSlash(name)))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				if string(got) != want {
+					t.Errorf("%s = %q; want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// checkNothingOutside reports an error for every path under dir other than
+// target, its contents, its parent directories and the named keep files.
+func checkNothingOutside(t *testing.T, dir, target string, keep ...string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, k := range keep {
+			if path == k {
+				return nil
+			}
+		}
+		switch {
+		case path == target || strings.HasPrefix(path, target+string(filepath.Separator)):
+			return nil
+		case fi.IsDir() && strings.HasPrefix(target, path+string(filepath.Separator)):
+			// A parent of target.
+			return nil
+		case path == dir:
+			return nil
+		}
+		t.Errorf("found %s outside of the target directory %s", path, target)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnpackArchiveTraversal(t *testing.T) {
+	names := []string{
+		"go/../../evil",
+		"go/../evil",
+		"../evil",
+		"go/..",
+		"go/../..",
+		`go\..\..\evil`,
+		"ABS/evil", // replaced by an absolute path inside the test's directory
+	}
+	for _, aw := range archiveWriters {
+		for _, name := range names {
+			t.Run(aw.ext+"/"+name, func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "unpack")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				name := name
+				if strings.HasPrefix(name, "ABS/") {
+					name = filepath.ToSlash(filepath.Join(dir, "evil"))
+				}
+				archive := filepath.Join(dir, "evil"+aw.ext)
+				aw.write(t, archive, []archiveEntry{
+					{"go/VERSION", "go1.99"},
+					{name, "pwned"},
+				})
+				target := filepath.Join(dir, "sdk", "go1.99")
+				err = unpackArchive(target, archive)
+				if _, ok := err.(*unsafePathError); !ok {
+					t.Fatalf("unpackArchive = %v; want *unsafePathError", err)
+				}
+				checkNothingOutside(t, dir, target, archive)
+			})
+		}
+	}
+}
+
+func TestInstallRemovesUnsafeArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Serve an archive whose second entry escapes the target directory,
+	// along with its correct checksum.
+	const version = "go1.99"
+	archiveName := path.Base(versionArchiveURL(version))
+	src := filepath.Join(dir, archiveName)
+	if strings.HasSuffix(archiveName, ".zip") {
+		writeZip(t, src, []archiveEntry{{"go/VERSION", version}, {"go/../evil", "pwned"}})
+	} else {
+		writeTarGz(t, src, []archiveEntry{{"go/VERSION", version}, {"go/../evil", "pwned"}})
+	}
+	archive, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + archiveName:
+			http.ServeContent(w, r, archiveName, time.Time{}, bytes.NewReader(archive))
+		case "/" + archiveName + ".sha256":
+			fmt.Fprintf(w, "%x\n", sha256.Sum256(archive))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer func(u string) { archiveBaseURL = u }(archiveBaseURL)
+	archiveBaseURL = ts.URL + "/"
+
+	target := filepath.Join(dir, "sdk", version)
+	err = install(target, version)
+	if err == nil || !strings.Contains(err.Error(), "unsafe entry name") {
+		t.Fatalf("install = %v; want unsafe archive entry error", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("install left %s behind after rejecting the archive: %v", target, err)
+	}
+	checkNothingOutside(t, dir, target, src)
+}
+
+func TestUnpackArchiveSniffsFormat(t *testing.T) {
+	tests := []struct {
+		name  string // archive file name
+		write func(*testing.T, string, []archiveEntry)
+	}{
+		{"go1.99.bin", writeTarGz},
+		{"go1.99", writeZip},
+		{"go1.99.tar.gz", writeZip},
+		{"go1.99.zip", writeTarGz},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "unpack")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			archive := filepath.Join(dir, tt.name)
+			tt.write(t, archive, []archiveEntry{{"go/VERSION", "go1.99"}})
+			target := filepath.Join(dir, "sdk")
+			if err := unpackArchive(target, archive); err != nil {
+				t.Fatalf("unpackArchive: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(target, "VERSION")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUnpackArchiveUnsupported(t *testing.T) {
+	for _, name := range []string{"go1.99.bin", "go1.99.tar.gz", "go1.99.tgz"} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "unpack")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			archive := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(archive, []byte("not an archive"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err = unpackArchive(filepath.Join(dir, "sdk"), archive)
+			if err == nil || !strings.Contains(err.Error(), "not a zip or tar.gz file") {
+				t.Errorf("unpackArchive = %v; want unsupported archive error", err)
+			}
+		})
+	}
+}